@@ -2,7 +2,6 @@ package bpe
 
 import (
 	"bufio"
-	"encoding/binary"
 	"errors"
 	"io"
 	"strconv"
@@ -17,11 +16,15 @@ type TokenID uint32
 // EncodedString is a sequence of subword token identifiers
 type EncodedString []TokenID
 
+// Well-known special token names. AddSpecialToken treats a token named
+// "bos" as the beginning-of-sequence token for backwards compatibility;
+// models are free to register any other name, including a differently
+// named BOS token added through AddBeginningOfSequenceToken.
 const (
-	unkToken = "<UNK>"
-	padToken = "<PAD>"
-	bosToken = "<BOS>"
-	eosToken = "<EOS>"
+	unkTokenName = "unk"
+	padTokenName = "pad"
+	bosTokenName = "bos"
+	eosTokenName = "eos"
 )
 
 type rule struct {
@@ -30,11 +33,22 @@ type rule struct {
 	result TokenID
 }
 
-type specialTokens struct {
-	unk int32
-	pad int32
-	bos int32
-	eos int32
+// specialTokenInfo is a single named special token and the traits that
+// affect how IDToToken/DecodeSentence treat it. isBeginningOfSequence
+// marks a token (conventionally "bos") whose rendered form, when it opens a
+// decoded sentence, is joined to the text after it: the space that would
+// follow it is removed.
+type specialTokenInfo struct {
+	id                    TokenID
+	isBeginningOfSequence bool
+}
+
+// specialTokenDisplay renders a special token's name the way the legacy
+// UNK/PAD/BOS/EOS tokens were always displayed, e.g. "unk" -> "<UNK>", so
+// user-registered tokens such as "sep" or "cls" get the same "<NAME>"
+// convention for free.
+func specialTokenDisplay(name string) string {
+	return "<" + strings.ToUpper(name) + ">"
 }
 
 // Model is a Byte-Pair encoding model, which supports encoding and decoding text into sequences
@@ -45,7 +59,7 @@ type Model struct {
 	rules         []rule
 	recipe        map[TokenID]EncodedString
 	revRecipe     map[string]TokenID
-	specialTokens specialTokens
+	specialTokens map[string]specialTokenInfo
 	spaceID       TokenID
 }
 
@@ -56,11 +70,42 @@ func newModel(nRules int) *Model {
 		make([]rule, nRules),
 		make(map[TokenID]EncodedString),
 		make(map[string]TokenID),
-		specialTokens{-1, -1, -1, -1},
+		make(map[string]specialTokenInfo),
 		0,
 	}
 }
 
+// SpecialTokens returns the name and id of every special token currently
+// registered on the model.
+func (m Model) SpecialTokens() map[string]TokenID {
+	tokens := make(map[string]TokenID, len(m.specialTokens))
+	for name, info := range m.specialTokens {
+		tokens[name] = info.id
+	}
+	return tokens
+}
+
+// AddSpecialToken registers a special token under name with the given id,
+// replacing any token already registered under that name. Registering a
+// token named "bos" marks it as the beginning-of-sequence token, so
+// DecodeSentence folds its rendered form against the following space the
+// same way the legacy <BOS> token always did. To mark a token under any
+// other name as the beginning-of-sequence token, use
+// AddBeginningOfSequenceToken instead.
+func (m *Model) AddSpecialToken(name string, id TokenID) {
+	m.specialTokens[name] = specialTokenInfo{id: id, isBeginningOfSequence: name == bosTokenName}
+}
+
+// AddBeginningOfSequenceToken registers a special token under name with
+// the given id and marks it as the beginning-of-sequence token regardless
+// of its name, so DecodeSentence folds its rendered form against the
+// following space the same way it does for a token named "bos". Use this
+// to register a beginning-of-sequence token under a name other than "bos",
+// e.g. "<s>" or "cls".
+func (m *Model) AddBeginningOfSequenceToken(name string, id TokenID) {
+	m.specialTokens[name] = specialTokenInfo{id: id, isBeginningOfSequence: true}
+}
+
 // DecodeToken converts the sequence of chars' ids into the string -
 // sequence of the corresponding chars
 func DecodeToken(token EncodedString, id2char map[TokenID]rune) (string, error) {
@@ -76,145 +121,20 @@ func DecodeToken(token EncodedString, id2char map[TokenID]rune) (string, error)
 	return word, nil
 }
 
-func (s specialTokens) toBinary() []byte {
-	bytesArray := make([]byte, 16)
-	binary.BigEndian.PutUint32(bytesArray, uint32(s.unk))
-	binary.BigEndian.PutUint32(bytesArray[4:], uint32(s.pad))
-	binary.BigEndian.PutUint32(bytesArray[8:], uint32(s.bos))
-	binary.BigEndian.PutUint32(bytesArray[12:], uint32(s.eos))
-	return bytesArray
-}
-
-func binaryToSpecialTokens(bytesArray []byte) (specialTokens, error) {
-	var s specialTokens
-	if len(bytesArray) < 16 {
-		logrus.Error("Bytes array length is too small")
-		return s, errors.New("bytes array is too small")
-	}
-	s.unk = int32(binary.BigEndian.Uint32(bytesArray))
-	s.pad = int32(binary.BigEndian.Uint32(bytesArray[4:]))
-	s.bos = int32(binary.BigEndian.Uint32(bytesArray[8:]))
-	s.eos = int32(binary.BigEndian.Uint32(bytesArray[12:]))
-	return s, nil
-}
-
-func (r rule) toBinary() []byte {
-	bytesArray := make([]byte, 12)
-	binary.BigEndian.PutUint32(bytesArray, uint32(r.left))
-	binary.BigEndian.PutUint32(bytesArray[4:], uint32(r.right))
-	binary.BigEndian.PutUint32(bytesArray[8:], uint32(r.result))
-	return bytesArray
-}
-
-func binaryToRule(bytesArray []byte) (rule, error) {
-	var r rule
-	if len(bytesArray) < 12 {
-		logrus.Error("Bytes array length is too small")
-		return r, errors.New("bytes array is too small")
-	}
-	r.left = TokenID(binary.BigEndian.Uint32(bytesArray))
-	r.right = TokenID(binary.BigEndian.Uint32(bytesArray[4:]))
-	r.result = TokenID(binary.BigEndian.Uint32(bytesArray[8:]))
-	return r, nil
-}
-
-// ReadModel loads the BPE model from the binary dump
-func ReadModel(reader io.Reader) (*Model, error) {
-	buf := make([]byte, 4)
-	var nChars, nRules int
-	if _, err := io.ReadFull(reader, buf); err != nil {
-		logrus.Error("Broken input: ", err)
-		return &Model{}, err
-	}
-	nChars = int(binary.BigEndian.Uint32(buf))
-	if _, err := io.ReadFull(reader, buf); err != nil {
-		logrus.Error("Broken input: ", err)
-		return &Model{}, err
-	}
-	nRules = int(binary.BigEndian.Uint32(buf))
-
-	model := newModel(nRules)
-	minCharID := TokenID(0)
-	for i := 0; i < nChars; i++ {
-		var char rune
-		var charID TokenID
-		if _, err := io.ReadFull(reader, buf); err != nil {
-			logrus.Error("Broken input: ", err)
-			return &Model{}, err
-		}
-		char = rune(binary.BigEndian.Uint32(buf))
-		if _, err := io.ReadFull(reader, buf); err != nil {
-			logrus.Error("Broken input: ", err)
-			return &Model{}, err
-		}
-		charID = TokenID(binary.BigEndian.Uint32(buf))
-		model.char2id[char] = charID
-		model.id2char[charID] = char
-		model.recipe[charID] = EncodedString{charID}
-		model.revRecipe[string(char)] = charID
-		if charID < minCharID || minCharID == 0 {
-			minCharID = charID
-			model.spaceID = charID
-		}
-	}
-	ruleBuf := make([]byte, 12)
-	for i := 0; i < nRules; i++ {
-		if _, err := io.ReadFull(reader, ruleBuf); err != nil {
-			logrus.Error("Broken input: ", err)
-			return &Model{}, err
-		}
-		rule, err := binaryToRule(ruleBuf)
-		if err != nil {
-			return model, err
-		}
-		model.rules[i] = rule
-		if _, ok := model.recipe[rule.left]; !ok {
-			logrus.Errorf("%d: token id not described before", rule.left)
-			return model, errors.New("token id is impossible")
-		}
-		if _, ok := model.recipe[rule.right]; !ok {
-			logrus.Errorf("%d: token id not described before", rule.right)
-			return model, errors.New("token id is impossible")
-		}
-		model.recipe[rule.result] = append(model.recipe[rule.left], model.recipe[rule.right]...)
-		resultString, err := DecodeToken(model.recipe[rule.result], model.id2char)
-		if err != nil {
-			logrus.Error("Unexpected token id inside the rules: ", err)
-			return model, err
-		}
-		model.revRecipe[resultString] = rule.result
-	}
-	specialTokensBuf := make([]byte, 16)
-	if _, err := io.ReadFull(reader, specialTokensBuf); err != nil {
-		logrus.Error("Broken input: ", err)
-		return &Model{}, err
-	}
-	specials, err := binaryToSpecialTokens(specialTokensBuf)
-	if err != nil {
-		return model, err
-	}
-	model.specialTokens = specials
-	return model, err
-}
-
 // IDToToken returns string token corresponding to the given token id.
 // If replaceSpace is true, special space token that is used for marking starts of words
-// will be replaced with space.
+// will be replaced with space. If several special tokens share an id, the
+// one whose name sorts first is used, so the result is deterministic
+// regardless of map iteration order.
 func (m Model) IDToToken(id TokenID, replaceSpace bool) (string, error) {
 	if _, ok := m.recipe[id]; !ok {
-		switch id {
-		case TokenID(m.specialTokens.unk):
-			return unkToken, nil
-		case TokenID(m.specialTokens.pad):
-			return padToken, nil
-		case TokenID(m.specialTokens.bos):
-			return bosToken, nil
-		case TokenID(m.specialTokens.eos):
-			return eosToken, nil
-		default:
-			logrus.Errorf("%d: token id is impossible", id)
-			return "", errors.New("token id is impossible")
+		for _, name := range sortedSpecialTokenNames(m.specialTokens) {
+			if m.specialTokens[name].id == id {
+				return specialTokenDisplay(name), nil
+			}
 		}
+		logrus.Errorf("%d: token id is impossible", id)
+		return "", errors.New("token id is impossible")
 	}
 	encodedToken, _ := m.recipe[id]
 	if encodedToken[0] == m.spaceID && replaceSpace {
@@ -238,11 +158,21 @@ func (m Model) DecodeSentence(encodedSentence EncodedString) (string, error) {
 		}
 		sentence += token
 	}
+	if sentence == "" {
+		return sentence, nil
+	}
 	if string(sentence[0]) == " " {
 		sentence = sentence[1:]
 	}
-	if sentence[:len(bosToken)+1] == bosToken+" " {
-		sentence = bosToken + sentence[len(bosToken)+1:]
+	for _, name := range sortedSpecialTokenNames(m.specialTokens) {
+		if !m.specialTokens[name].isBeginningOfSequence {
+			continue
+		}
+		display := specialTokenDisplay(name)
+		prefix := display + " "
+		if strings.HasPrefix(sentence, prefix) {
+			sentence = display + sentence[len(prefix):]
+		}
 	}
 	return sentence, nil
 }
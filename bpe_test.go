@@ -0,0 +1,27 @@
+package bpe
+
+import "testing"
+
+// TestAddBeginningOfSequenceTokenFoldsRegardlessOfName is a regression test
+// ensuring the beginning-of-sequence trait is not only reachable through a
+// token literally named "bos". A token registered under any other name
+// must fold against the following space the same way.
+func TestAddBeginningOfSequenceTokenFoldsRegardlessOfName(t *testing.T) {
+	m := buildTestModel()
+	m.AddBeginningOfSequenceToken("cls", 6)
+
+	if !m.specialTokens["cls"].isBeginningOfSequence {
+		t.Fatalf("expected \"cls\" to be marked as the beginning-of-sequence token")
+	}
+
+	// Token 2 is the space marker, so IDToToken renders it (and the "a"
+	// that follows) as " a"; DecodeSentence must fold that leading space
+	// against "<CLS>" the same way it would for a token named "bos".
+	sentence, err := m.DecodeSentence(EncodedString{6, 2, 0})
+	if err != nil {
+		t.Fatalf("DecodeSentence: %v", err)
+	}
+	if sentence != "<CLS>a" {
+		t.Errorf("got %q, want %q", sentence, "<CLS>a")
+	}
+}
@@ -0,0 +1,543 @@
+package bpe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrCorruptModel is returned by ReadModel when a frame's CRC-32 checksum
+// does not match the bytes that were actually read, which means the dump
+// was truncated or corrupted in transit rather than merely written by an
+// older/newer format version.
+type ErrCorruptModel struct {
+	Frame    string
+	Expected uint32
+	Computed uint32
+}
+
+func (e *ErrCorruptModel) Error() string {
+	return fmt.Sprintf("bpe: corrupt model dump: frame %q checksum mismatch (expected %08x, got %08x)",
+		e.Frame, e.Expected, e.Computed)
+}
+
+// writeFrame writes payload as a single length-prefixed frame: a 4-byte
+// big-endian length, the payload itself, and a 4-byte big-endian CRC-32
+// (IEEE polynomial). The checksum is seeded with prevCRC, so each frame's
+// sum also covers every frame written before it - the same rolling-CRC
+// chaining used by write-ahead logs, which catches a frame being dropped
+// or reordered even though its own bytes are internally consistent.
+func writeFrame(w io.Writer, payload []byte, prevCRC uint32) (newCRC uint32, err error) {
+	lenBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenBuf, uint32(len(payload)))
+	if _, err := w.Write(lenBuf); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return 0, err
+	}
+	newCRC = crc32.Update(prevCRC, crc32.IEEETable, payload)
+	crcBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(crcBuf, newCRC)
+	if _, err := w.Write(crcBuf); err != nil {
+		return 0, err
+	}
+	return newCRC, nil
+}
+
+// maxFrameLength bounds the length prefix readFrame will trust enough to
+// allocate for. No real model dump comes close to it; its only job is to
+// turn a corrupted length prefix into a reported error instead of a
+// multi-gigabyte allocation attempt.
+const maxFrameLength = 1 << 28 // 256 MiB
+
+// maxHeaderCount bounds an nChars/nRules value decoded from a header frame
+// against maxFrameLength divided by minItemSize, the smallest number of
+// bytes that format can possibly spend per char or rule entry. The header
+// frame itself is only 8 bytes, so its own length prefix sails under
+// maxFrameLength regardless of what counts it declares; without this check
+// a corrupted nRules is trusted all the way into newModel's preallocation
+// before the (correctly bounded) char table or rules frame is ever read,
+// turning a corrupted count into an out-of-memory crash instead of a
+// reported error.
+func maxHeaderCount(minItemSize int) int {
+	return maxFrameLength / minItemSize
+}
+
+// readFrame reads back a frame written by writeFrame and verifies its
+// checksum against prevCRC, returning an *ErrCorruptModel tagged with name
+// on mismatch so callers can report which part of the dump is broken.
+func readFrame(r io.Reader, name string, prevCRC uint32) (payload []byte, newCRC uint32, err error) {
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(lenBuf)
+	if length > maxFrameLength {
+		return nil, 0, fmt.Errorf("bpe: corrupt model dump: frame %q declares implausible length %d (max %d)",
+			name, length, maxFrameLength)
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, err
+	}
+	crcBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, crcBuf); err != nil {
+		return nil, 0, err
+	}
+	expected := binary.BigEndian.Uint32(crcBuf)
+	computed := crc32.Update(prevCRC, crc32.IEEETable, payload)
+	if computed != expected {
+		return nil, 0, &ErrCorruptModel{Frame: name, Expected: expected, Computed: computed}
+	}
+	return payload, computed, nil
+}
+
+// legacySpecialTokens is the fixed 16-byte UNK/PAD/BOS/EOS layout that
+// modelVersionFixedWidth dumps carried before special tokens became a
+// name->id map. readModelFixedWidth still decodes it through this type and
+// converts it into a specialTokenInfo map on the way into the Model, so a
+// dump written at that format version keeps loading.
+type legacySpecialTokens struct {
+	unk int32
+	pad int32
+	bos int32
+	eos int32
+}
+
+func binaryToSpecialTokens(bytesArray []byte) (legacySpecialTokens, error) {
+	var s legacySpecialTokens
+	if len(bytesArray) < 16 {
+		logrus.Error("Bytes array length is too small")
+		return s, errors.New("bytes array is too small")
+	}
+	s.unk = int32(binary.BigEndian.Uint32(bytesArray))
+	s.pad = int32(binary.BigEndian.Uint32(bytesArray[4:]))
+	s.bos = int32(binary.BigEndian.Uint32(bytesArray[8:]))
+	s.eos = int32(binary.BigEndian.Uint32(bytesArray[12:]))
+	return s, nil
+}
+
+// legacyToSpecialTokenMap converts an old-format UNK/PAD/BOS/EOS struct
+// (where -1 means "unset") into the name->id map Model now carries,
+// marking the bos slot as the beginning-of-sequence token.
+func legacyToSpecialTokenMap(s legacySpecialTokens) map[string]specialTokenInfo {
+	tokens := make(map[string]specialTokenInfo)
+	if s.unk >= 0 {
+		tokens[unkTokenName] = specialTokenInfo{id: TokenID(s.unk)}
+	}
+	if s.pad >= 0 {
+		tokens[padTokenName] = specialTokenInfo{id: TokenID(s.pad)}
+	}
+	if s.bos >= 0 {
+		tokens[bosTokenName] = specialTokenInfo{id: TokenID(s.bos), isBeginningOfSequence: true}
+	}
+	if s.eos >= 0 {
+		tokens[eosTokenName] = specialTokenInfo{id: TokenID(s.eos)}
+	}
+	return tokens
+}
+
+// sortedSpecialTokenNames returns a special token map's names in
+// ascending order, so the binary/JSON writers below serialize special
+// tokens in a deterministic order regardless of Go's randomized map
+// iteration.
+func sortedSpecialTokenNames(tokens map[string]specialTokenInfo) []string {
+	names := make([]string, 0, len(tokens))
+	for name := range tokens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// specialTokenMapToBinary serializes a name->id special token map as
+// (count uint32, [(nameLen uint32, nameBytes, id int32, isBeginningOfSequence
+// byte)...]), in name order so two calls on the same tokens always produce
+// the same bytes. Unlike the legacySpecialTokens layout it carries only
+// registered tokens, under arbitrary names, so it isn't limited to four
+// fixed slots.
+func specialTokenMapToBinary(tokens map[string]specialTokenInfo) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(len(tokens)))
+	for _, name := range sortedSpecialTokenNames(tokens) {
+		info := tokens[name]
+		nameBytes := []byte(name)
+		entry := make([]byte, 4+len(nameBytes)+4+1)
+		binary.BigEndian.PutUint32(entry, uint32(len(nameBytes)))
+		copy(entry[4:], nameBytes)
+		binary.BigEndian.PutUint32(entry[4+len(nameBytes):], uint32(int32(info.id)))
+		if info.isBeginningOfSequence {
+			entry[4+len(nameBytes)+4] = 1
+		}
+		buf = append(buf, entry...)
+	}
+	return buf
+}
+
+// binaryToSpecialTokenMap decodes the format written by
+// specialTokenMapToBinary, including the isBeginningOfSequence byte that
+// records the trait regardless of the token's name.
+func binaryToSpecialTokenMap(buf []byte) (map[string]specialTokenInfo, error) {
+	if len(buf) < 4 {
+		return nil, errors.New("bytes array is too small")
+	}
+	count := binary.BigEndian.Uint32(buf)
+	pos := 4
+	tokens := make(map[string]specialTokenInfo, count)
+	for i := uint32(0); i < count; i++ {
+		if pos+4 > len(buf) {
+			return nil, errors.New("bytes array is too small")
+		}
+		nameLen := int(binary.BigEndian.Uint32(buf[pos:]))
+		pos += 4
+		if nameLen < 0 || pos+nameLen+4+1 > len(buf) {
+			return nil, errors.New("bytes array is too small")
+		}
+		name := string(buf[pos : pos+nameLen])
+		pos += nameLen
+		id := int32(binary.BigEndian.Uint32(buf[pos:]))
+		pos += 4
+		isBeginningOfSequence := buf[pos] != 0
+		pos++
+		tokens[name] = specialTokenInfo{id: TokenID(id), isBeginningOfSequence: isBeginningOfSequence}
+	}
+	return tokens, nil
+}
+
+func (r rule) toBinary() []byte {
+	bytesArray := make([]byte, 12)
+	binary.BigEndian.PutUint32(bytesArray, uint32(r.left))
+	binary.BigEndian.PutUint32(bytesArray[4:], uint32(r.right))
+	binary.BigEndian.PutUint32(bytesArray[8:], uint32(r.result))
+	return bytesArray
+}
+
+// sortedChars returns a char2id map's runes ordered by ascending id, so
+// the char table below is written in a deterministic order regardless of
+// Go's randomized map iteration.
+func sortedChars(char2id map[rune]TokenID) []rune {
+	chars := make([]rune, 0, len(char2id))
+	for char := range char2id {
+		chars = append(chars, char)
+	}
+	sort.Slice(chars, func(i, j int) bool { return char2id[chars[i]] < char2id[chars[j]] })
+	return chars
+}
+
+func binaryToRule(bytesArray []byte) (rule, error) {
+	var r rule
+	if len(bytesArray) < 12 {
+		logrus.Error("Bytes array length is too small")
+		return r, errors.New("bytes array is too small")
+	}
+	r.left = TokenID(binary.BigEndian.Uint32(bytesArray))
+	r.right = TokenID(binary.BigEndian.Uint32(bytesArray[4:]))
+	r.result = TokenID(binary.BigEndian.Uint32(bytesArray[8:]))
+	return r, nil
+}
+
+// modelMagic is the 4-byte ASCII prefix every model dump starts with,
+// followed by a uint32 format version. It lets ReadModel recognize a
+// genuine YTTM dump and reject arbitrary input before it tries to decode
+// anything.
+//
+// Dumps without this header have no magic to check and no CRC framing
+// around their blocks at all, so ReadModel rejects them outright as
+// bad-magic input rather than attempting to sniff and decode them.
+const modelMagic = "YTTM"
+
+// Model format versions. Each one names a decoder registered in
+// modelDecoders; adding a new on-disk layout means adding a new version
+// here and a new entry in the registry, not branching existing decoders.
+const (
+	modelVersionFixedWidth            uint32 = 1
+	modelVersionVarint                uint32 = 2
+	modelVersionFixedWidthNamedTokens uint32 = 3
+	modelVersionVarintNamedTokens     uint32 = 4
+)
+
+type modelDecoder func(io.Reader) (*Model, error)
+
+var modelDecoders = map[uint32]modelDecoder{
+	modelVersionFixedWidth:            readModelFixedWidth,
+	modelVersionVarint:                readModelVarint,
+	modelVersionFixedWidthNamedTokens: readModelFixedWidthNamedTokens,
+	modelVersionVarintNamedTokens:     readModelVarintNamedTokens,
+}
+
+// ErrUnsupportedModelVersion is returned by ReadModel and ModelInfo when a
+// dump declares a format version this build has no decoder for.
+type ErrUnsupportedModelVersion struct {
+	Got       uint32
+	Supported []uint32
+}
+
+func (e *ErrUnsupportedModelVersion) Error() string {
+	return fmt.Sprintf("bpe: unsupported model version %d (supported: %v)", e.Got, e.Supported)
+}
+
+func supportedModelVersions() []uint32 {
+	versions := make([]uint32, 0, len(modelDecoders))
+	for v := range modelDecoders {
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+func readModelMagicAndVersion(reader io.Reader) (uint32, error) {
+	magic := make([]byte, len(modelMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return 0, err
+	}
+	if string(magic) != modelMagic {
+		return 0, fmt.Errorf("bpe: not a YTTM model dump (bad magic %q)", magic)
+	}
+	versionBuf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, versionBuf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(versionBuf), nil
+}
+
+func writeModelMagicAndVersion(w io.Writer, version uint32) error {
+	if _, err := io.WriteString(w, modelMagic); err != nil {
+		return err
+	}
+	versionBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(versionBuf, version)
+	_, err := w.Write(versionBuf)
+	return err
+}
+
+// ModelInfo inspects a model dump's magic and version header and reports
+// the declared vocabulary and rule-table sizes without fully loading the
+// model, for tooling that wants to sniff a dump cheaply.
+func ModelInfo(reader io.Reader) (version uint32, nChars int, nRules int, err error) {
+	version, err = readModelMagicAndVersion(reader)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	switch version {
+	case modelVersionFixedWidth, modelVersionFixedWidthNamedTokens:
+		header, _, ferr := readFrame(reader, "header", 0)
+		if ferr != nil {
+			return version, 0, 0, ferr
+		}
+		if len(header) < 8 {
+			return version, 0, 0, errors.New("broken input: header frame too small")
+		}
+		return version, int(binary.BigEndian.Uint32(header)), int(binary.BigEndian.Uint32(header[4:])), nil
+	case modelVersionVarint, modelVersionVarintNamedTokens:
+		header, _, ferr := readFrame(reader, "header", 0)
+		if ferr != nil {
+			return version, 0, 0, ferr
+		}
+		headerReader := bytes.NewReader(header)
+		nc, uerr := binary.ReadUvarint(headerReader)
+		if uerr != nil {
+			return version, 0, 0, errors.New("broken input: malformed header frame")
+		}
+		nr, uerr := binary.ReadUvarint(headerReader)
+		if uerr != nil {
+			return version, 0, 0, errors.New("broken input: malformed header frame")
+		}
+		return version, int(nc), int(nr), nil
+	default:
+		return version, 0, 0, &ErrUnsupportedModelVersion{Got: version, Supported: supportedModelVersions()}
+	}
+}
+
+// WriteModel writes m to w as the magic/version header followed by a
+// sequence of CRC-framed blocks: header (char and rule counts), char
+// table, rules block and special tokens, each one a writeFrame payload
+// whose checksum chains off the previous frame's. ReadModel verifies
+// every frame as it reads, so a truncated or corrupted dump is reported
+// instead of silently producing a broken Model. The special tokens block
+// uses the name->id map layout, so this writes modelVersionFixedWidthNamedTokens;
+// modelVersionFixedWidth dumps, with their fixed UNK/PAD/BOS/EOS special
+// tokens, are only ever read back, never written, by this build.
+func WriteModel(w io.Writer, m *Model) error {
+	if err := writeModelMagicAndVersion(w, modelVersionFixedWidthNamedTokens); err != nil {
+		return err
+	}
+
+	var crc uint32
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(m.char2id)))
+	binary.BigEndian.PutUint32(header[4:], uint32(len(m.rules)))
+	crc, err := writeFrame(w, header, crc)
+	if err != nil {
+		return err
+	}
+
+	charTable := make([]byte, 0, 8*len(m.char2id))
+	for _, char := range sortedChars(m.char2id) {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint32(buf, uint32(char))
+		binary.BigEndian.PutUint32(buf[4:], uint32(m.char2id[char]))
+		charTable = append(charTable, buf...)
+	}
+	crc, err = writeFrame(w, charTable, crc)
+	if err != nil {
+		return err
+	}
+
+	rulesBlock := make([]byte, 0, 12*len(m.rules))
+	for _, r := range m.rules {
+		rulesBlock = append(rulesBlock, r.toBinary()...)
+	}
+	crc, err = writeFrame(w, rulesBlock, crc)
+	if err != nil {
+		return err
+	}
+
+	_, err = writeFrame(w, specialTokenMapToBinary(m.specialTokens), crc)
+	return err
+}
+
+// ReadModel loads the BPE model from a dump produced by WriteModel or
+// WriteModelVarint. It checks the magic header and dispatches on the
+// format version to the matching decoder, returning
+// *ErrUnsupportedModelVersion if the dump declares one this build does
+// not know how to read.
+func ReadModel(reader io.Reader) (*Model, error) {
+	version, err := readModelMagicAndVersion(reader)
+	if err != nil {
+		logrus.Error("Broken input: ", err)
+		return &Model{}, err
+	}
+	decode, ok := modelDecoders[version]
+	if !ok {
+		err := &ErrUnsupportedModelVersion{Got: version, Supported: supportedModelVersions()}
+		logrus.Error("Broken input: ", err)
+		return &Model{}, err
+	}
+	return decode(reader)
+}
+
+// readModelFixedWidthBody decodes every frame shared by
+// modelVersionFixedWidth and modelVersionFixedWidthNamedTokens - header,
+// char table and rules, all fixed-width big-endian uint32 fields - and
+// returns the still-undecoded special tokens frame so each version's
+// decoder can interpret it in its own layout.
+func readModelFixedWidthBody(reader io.Reader) (model *Model, specialTokensBuf []byte, err error) {
+	var crc uint32
+
+	header, crc, err := readFrame(reader, "header", crc)
+	if err != nil {
+		logrus.Error("Broken input: ", err)
+		return &Model{}, nil, err
+	}
+	if len(header) < 8 {
+		return &Model{}, nil, errors.New("broken input: header frame too small")
+	}
+	nChars := int(binary.BigEndian.Uint32(header))
+	nRules := int(binary.BigEndian.Uint32(header[4:]))
+	if nChars > maxHeaderCount(8) {
+		return &Model{}, nil, fmt.Errorf("broken input: implausible char count %d", nChars)
+	}
+	if nRules > maxHeaderCount(12) {
+		return &Model{}, nil, fmt.Errorf("broken input: implausible rule count %d", nRules)
+	}
+
+	model = newModel(nRules)
+
+	charTable, crc, err := readFrame(reader, "char table", crc)
+	if err != nil {
+		logrus.Error("Broken input: ", err)
+		return &Model{}, nil, err
+	}
+	if len(charTable) != 8*nChars {
+		return &Model{}, nil, errors.New("broken input: char table frame has unexpected size")
+	}
+	minCharID := TokenID(0)
+	for i := 0; i < nChars; i++ {
+		char := rune(binary.BigEndian.Uint32(charTable[8*i:]))
+		charID := TokenID(binary.BigEndian.Uint32(charTable[8*i+4:]))
+		model.char2id[char] = charID
+		model.id2char[charID] = char
+		model.recipe[charID] = EncodedString{charID}
+		model.revRecipe[string(char)] = charID
+		if charID < minCharID || minCharID == 0 {
+			minCharID = charID
+			model.spaceID = charID
+		}
+	}
+
+	rulesBlock, crc, err := readFrame(reader, "rules", crc)
+	if err != nil {
+		logrus.Error("Broken input: ", err)
+		return &Model{}, nil, err
+	}
+	if len(rulesBlock) != 12*nRules {
+		return &Model{}, nil, errors.New("broken input: rules frame has unexpected size")
+	}
+	for i := 0; i < nRules; i++ {
+		rule, err := binaryToRule(rulesBlock[12*i : 12*i+12])
+		if err != nil {
+			return model, nil, err
+		}
+		model.rules[i] = rule
+		if _, ok := model.recipe[rule.left]; !ok {
+			logrus.Errorf("%d: token id not described before", rule.left)
+			return model, nil, errors.New("token id is impossible")
+		}
+		if _, ok := model.recipe[rule.right]; !ok {
+			logrus.Errorf("%d: token id not described before", rule.right)
+			return model, nil, errors.New("token id is impossible")
+		}
+		model.recipe[rule.result] = append(model.recipe[rule.left], model.recipe[rule.right]...)
+		resultString, err := DecodeToken(model.recipe[rule.result], model.id2char)
+		if err != nil {
+			logrus.Error("Unexpected token id inside the rules: ", err)
+			return model, nil, err
+		}
+		model.revRecipe[resultString] = rule.result
+	}
+
+	specialTokensBuf, _, err = readFrame(reader, "special tokens", crc)
+	if err != nil {
+		logrus.Error("Broken input: ", err)
+		return &Model{}, nil, err
+	}
+	return model, specialTokensBuf, nil
+}
+
+// readModelFixedWidth decodes a modelVersionFixedWidth dump, whose special
+// tokens frame is the fixed 16-byte UNK/PAD/BOS/EOS layout.
+func readModelFixedWidth(reader io.Reader) (*Model, error) {
+	model, specialTokensBuf, err := readModelFixedWidthBody(reader)
+	if err != nil {
+		return model, err
+	}
+	legacy, err := binaryToSpecialTokens(specialTokensBuf)
+	if err != nil {
+		return model, err
+	}
+	model.specialTokens = legacyToSpecialTokenMap(legacy)
+	return model, nil
+}
+
+// readModelFixedWidthNamedTokens decodes a modelVersionFixedWidthNamedTokens
+// dump, whose special tokens frame is the name->id map layout written by
+// specialTokenMapToBinary.
+func readModelFixedWidthNamedTokens(reader io.Reader) (*Model, error) {
+	model, specialTokensBuf, err := readModelFixedWidthBody(reader)
+	if err != nil {
+		return model, err
+	}
+	specials, err := binaryToSpecialTokenMap(specialTokensBuf)
+	if err != nil {
+		return model, err
+	}
+	model.specialTokens = specials
+	return model, nil
+}
@@ -0,0 +1,292 @@
+package bpe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// buildTestModel returns a small but non-trivial model exercising chars,
+// rules and special tokens, used as a fixture across the model_io,
+// model_varint and model_json tests.
+func buildTestModel() *Model {
+	m := newModel(1)
+	m.char2id['a'] = 0
+	m.char2id['b'] = 1
+	m.char2id[' '] = 2
+	m.id2char[0] = 'a'
+	m.id2char[1] = 'b'
+	m.id2char[2] = ' '
+	m.recipe[0] = EncodedString{0}
+	m.recipe[1] = EncodedString{1}
+	m.recipe[2] = EncodedString{2}
+	m.revRecipe["a"] = 0
+	m.revRecipe["b"] = 1
+	m.revRecipe[" "] = 2
+	m.spaceID = 2
+	m.rules[0] = rule{left: 0, right: 1, result: 3}
+	m.recipe[3] = EncodedString{0, 1}
+	m.revRecipe["ab"] = 3
+	m.AddSpecialToken(unkTokenName, 4)
+	m.AddSpecialToken(bosTokenName, 5)
+	return m
+}
+
+func TestWriteModelReadModelRoundTrip(t *testing.T) {
+	m := buildTestModel()
+	var buf bytes.Buffer
+	if err := WriteModel(&buf, m); err != nil {
+		t.Fatalf("WriteModel: %v", err)
+	}
+	got, err := ReadModel(&buf)
+	if err != nil {
+		t.Fatalf("ReadModel: %v", err)
+	}
+	if len(got.char2id) != len(m.char2id) || len(got.rules) != len(m.rules) || len(got.specialTokens) != len(m.specialTokens) {
+		t.Fatalf("round-tripped model shape mismatch: got %+v, want %+v", got, m)
+	}
+	if !reflect.DeepEqual(got.rules, m.rules) {
+		t.Errorf("rules: got %+v, want %+v", got.rules, m.rules)
+	}
+	for name, info := range m.specialTokens {
+		if got.specialTokens[name] != info {
+			t.Errorf("special token %q: got %+v, want %+v", name, got.specialTokens[name], info)
+		}
+	}
+}
+
+func TestWriteModelDeterministic(t *testing.T) {
+	m := buildTestModel()
+	var first, second bytes.Buffer
+	if err := WriteModel(&first, m); err != nil {
+		t.Fatalf("WriteModel: %v", err)
+	}
+	if err := WriteModel(&second, m); err != nil {
+		t.Fatalf("WriteModel: %v", err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Fatalf("WriteModel produced different bytes across two calls on the same model")
+	}
+}
+
+func TestReadModelDetectsFlippedBytes(t *testing.T) {
+	m := buildTestModel()
+	var buf bytes.Buffer
+	if err := WriteModel(&buf, m); err != nil {
+		t.Fatalf("WriteModel: %v", err)
+	}
+	original := buf.Bytes()
+	for i := range original {
+		corrupted := make([]byte, len(original))
+		copy(corrupted, original)
+		corrupted[i] ^= 0xff
+		if _, err := ReadModel(bytes.NewReader(corrupted)); err == nil {
+			t.Errorf("flipping byte %d went undetected", i)
+		}
+	}
+}
+
+func TestReadFrameRejectsImplausibleLength(t *testing.T) {
+	m := buildTestModel()
+	var buf bytes.Buffer
+	if err := WriteModel(&buf, m); err != nil {
+		t.Fatalf("WriteModel: %v", err)
+	}
+	corrupted := buf.Bytes()
+	// The header frame's length prefix immediately follows the 8-byte magic
+	// and version. Corrupting it to an implausible value must be reported
+	// as an error rather than attempting a giant allocation.
+	corrupted[8] = 0x7f
+	corrupted[9] = 0xff
+	corrupted[10] = 0xff
+	corrupted[11] = 0xff
+	if _, err := ReadModel(bytes.NewReader(corrupted)); err == nil {
+		t.Fatal("expected an error for an implausible frame length, got nil")
+	}
+}
+
+// TestReadModelRejectsImplausibleHeaderCounts verifies that a header frame
+// declaring an implausible nRules - small enough to pass readFrame's own
+// maxFrameLength check on the header's physical length, but far larger
+// than the rules frame that actually follows it could ever encode - is
+// reported as an error instead of being handed straight to newModel's
+// preallocation, for both the fixed-width and varint decoders.
+func TestReadModelRejectsImplausibleHeaderCounts(t *testing.T) {
+	const implausibleRuleCount = 0xFFFFFFF0
+
+	t.Run("FixedWidth", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeModelMagicAndVersion(&buf, modelVersionFixedWidthNamedTokens); err != nil {
+			t.Fatalf("writeModelMagicAndVersion: %v", err)
+		}
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header, 0)
+		binary.BigEndian.PutUint32(header[4:], implausibleRuleCount)
+		if _, err := writeFrame(&buf, header, 0); err != nil {
+			t.Fatalf("writeFrame(header): %v", err)
+		}
+		if _, err := ReadModel(bytes.NewReader(buf.Bytes())); err == nil {
+			t.Fatal("expected an error for an implausible rule count, got nil")
+		}
+	})
+
+	t.Run("Varint", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeModelMagicAndVersion(&buf, modelVersionVarintNamedTokens); err != nil {
+			t.Fatalf("writeModelMagicAndVersion: %v", err)
+		}
+		header := appendUvarint(nil, 0)
+		header = appendUvarint(header, implausibleRuleCount)
+		if _, err := writeFrame(&buf, header, 0); err != nil {
+			t.Fatalf("writeFrame(header): %v", err)
+		}
+		if _, err := ReadModel(bytes.NewReader(buf.Bytes())); err == nil {
+			t.Fatal("expected an error for an implausible rule count, got nil")
+		}
+	})
+}
+
+// TestReadModelDecodesLegacyFixedWidthSpecialTokens verifies that a
+// modelVersionFixedWidth dump - written before special tokens became a
+// name->id map, with a 16-byte fixed UNK/PAD/BOS/EOS special-tokens frame
+// - still loads, and that its bos slot becomes the beginning-of-sequence
+// special token.
+func TestReadModelDecodesLegacyFixedWidthSpecialTokens(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeModelMagicAndVersion(&buf, modelVersionFixedWidth); err != nil {
+		t.Fatalf("writeModelMagicAndVersion: %v", err)
+	}
+
+	var crc uint32
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, 1)
+	binary.BigEndian.PutUint32(header[4:], 0)
+	crc, err := writeFrame(&buf, header, crc)
+	if err != nil {
+		t.Fatalf("writeFrame(header): %v", err)
+	}
+
+	charTable := make([]byte, 8)
+	binary.BigEndian.PutUint32(charTable, uint32('a'))
+	binary.BigEndian.PutUint32(charTable[4:], 0)
+	crc, err = writeFrame(&buf, charTable, crc)
+	if err != nil {
+		t.Fatalf("writeFrame(char table): %v", err)
+	}
+
+	crc, err = writeFrame(&buf, nil, crc)
+	if err != nil {
+		t.Fatalf("writeFrame(rules): %v", err)
+	}
+
+	var unset int32 = -1
+	var bosID int32 = 0
+	legacy := make([]byte, 16)
+	binary.BigEndian.PutUint32(legacy, uint32(unset))      // unk: unset
+	binary.BigEndian.PutUint32(legacy[4:], uint32(unset))  // pad: unset
+	binary.BigEndian.PutUint32(legacy[8:], uint32(bosID))  // bos: id 0
+	binary.BigEndian.PutUint32(legacy[12:], uint32(unset)) // eos: unset
+	if _, err := writeFrame(&buf, legacy, crc); err != nil {
+		t.Fatalf("writeFrame(special tokens): %v", err)
+	}
+
+	got, err := ReadModel(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadModel: %v", err)
+	}
+	if len(got.specialTokens) != 1 {
+		t.Fatalf("expected exactly one special token, got %+v", got.specialTokens)
+	}
+	if info := got.specialTokens[bosTokenName]; info.id != 0 || !info.isBeginningOfSequence {
+		t.Errorf("bos: got %+v, want {id: 0, isBeginningOfSequence: true}", info)
+	}
+}
+
+// TestReadModelDecodesLegacyVarintSpecialTokens verifies that a
+// modelVersionVarint dump - written before special tokens became a
+// name->id map, with a four-slot varint UNK/PAD/BOS/EOS special-tokens
+// frame - still loads, and that its bos slot becomes the
+// beginning-of-sequence special token.
+func TestReadModelDecodesLegacyVarintSpecialTokens(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeModelMagicAndVersion(&buf, modelVersionVarint); err != nil {
+		t.Fatalf("writeModelMagicAndVersion: %v", err)
+	}
+
+	var crc uint32
+	header := appendUvarint(nil, 1)
+	header = appendUvarint(header, 0)
+	crc, err := writeFrame(&buf, header, crc)
+	if err != nil {
+		t.Fatalf("writeFrame(header): %v", err)
+	}
+
+	charTable := appendUvarint(nil, uint64('a'))
+	charTable = appendUvarint(charTable, 0)
+	crc, err = writeFrame(&buf, charTable, crc)
+	if err != nil {
+		t.Fatalf("writeFrame(char table): %v", err)
+	}
+
+	crc, err = writeFrame(&buf, nil, crc)
+	if err != nil {
+		t.Fatalf("writeFrame(rules): %v", err)
+	}
+
+	legacy := appendVarint(nil, -1)   // unk: unset
+	legacy = appendVarint(legacy, -1) // pad: unset
+	legacy = appendVarint(legacy, 0)  // bos: id 0
+	legacy = appendVarint(legacy, -1) // eos: unset
+	if _, err := writeFrame(&buf, legacy, crc); err != nil {
+		t.Fatalf("writeFrame(special tokens): %v", err)
+	}
+
+	got, err := ReadModel(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadModel: %v", err)
+	}
+	if len(got.specialTokens) != 1 {
+		t.Fatalf("expected exactly one special token, got %+v", got.specialTokens)
+	}
+	if info := got.specialTokens[bosTokenName]; info.id != 0 || !info.isBeginningOfSequence {
+		t.Errorf("bos: got %+v, want {id: 0, isBeginningOfSequence: true}", info)
+	}
+}
+
+func TestModelInfo(t *testing.T) {
+	m := buildTestModel()
+	var buf bytes.Buffer
+	if err := WriteModel(&buf, m); err != nil {
+		t.Fatalf("WriteModel: %v", err)
+	}
+	version, nChars, nRules, err := ModelInfo(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ModelInfo: %v", err)
+	}
+	if version != modelVersionFixedWidthNamedTokens {
+		t.Errorf("version: got %d, want %d", version, modelVersionFixedWidthNamedTokens)
+	}
+	if nChars != len(m.char2id) {
+		t.Errorf("nChars: got %d, want %d", nChars, len(m.char2id))
+	}
+	if nRules != len(m.rules) {
+		t.Errorf("nRules: got %d, want %d", nRules, len(m.rules))
+	}
+}
+
+func TestReadModelUnsupportedVersion(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeModelMagicAndVersion(&buf, 99); err != nil {
+		t.Fatalf("writeModelMagicAndVersion: %v", err)
+	}
+	_, err := ReadModel(&buf)
+	var unsupported *ErrUnsupportedModelVersion
+	if !errors.As(err, &unsupported) {
+		t.Fatalf("expected *ErrUnsupportedModelVersion, got %v (%T)", err, err)
+	}
+	if unsupported.Got != 99 {
+		t.Errorf("Got: got %d, want 99", unsupported.Got)
+	}
+}
@@ -0,0 +1,124 @@
+package bpe
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// jsonModelVersion identifies the shape of the JSON export below, so a
+// future change to the schema can be told apart from this one.
+const jsonModelVersion = 1
+
+type jsonChar struct {
+	Char string  `json:"char"`
+	ID   TokenID `json:"id"`
+}
+
+type jsonRule struct {
+	Left   TokenID `json:"left"`
+	Right  TokenID `json:"right"`
+	Result TokenID `json:"result"`
+}
+
+type jsonSpecialToken struct {
+	Name                  string  `json:"name"`
+	ID                    TokenID `json:"id"`
+	IsBeginningOfSequence bool    `json:"isBeginningOfSequence,omitempty"`
+}
+
+type jsonModel struct {
+	Version       int                `json:"version"`
+	Chars         []jsonChar         `json:"chars"`
+	Rules         []jsonRule         `json:"rules"`
+	SpecialTokens []jsonSpecialToken `json:"specialTokens"`
+}
+
+// WriteModelJSON writes m to w as human-readable JSON: the char alphabet
+// as {char, id} entries, the rules in order as {left, right, result}
+// triples, and the special tokens as {name, id} entries (plus
+// isBeginningOfSequence when that trait is set), alongside a version field. This is meant for inspecting or hand-editing a model,
+// not as a replacement for the compact WriteModel/WriteModelVarint dumps.
+func WriteModelJSON(w io.Writer, m *Model) error {
+	jm := jsonModel{
+		Version:       jsonModelVersion,
+		Chars:         make([]jsonChar, 0, len(m.char2id)),
+		Rules:         make([]jsonRule, len(m.rules)),
+		SpecialTokens: make([]jsonSpecialToken, 0, len(m.specialTokens)),
+	}
+	for _, name := range sortedSpecialTokenNames(m.specialTokens) {
+		info := m.specialTokens[name]
+		jm.SpecialTokens = append(jm.SpecialTokens, jsonSpecialToken{
+			Name:                  name,
+			ID:                    info.id,
+			IsBeginningOfSequence: info.isBeginningOfSequence,
+		})
+	}
+	for _, char := range sortedChars(m.char2id) {
+		jm.Chars = append(jm.Chars, jsonChar{Char: string(char), ID: m.char2id[char]})
+	}
+	for i, r := range m.rules {
+		jm.Rules[i] = jsonRule{Left: r.left, Right: r.right, Result: r.result}
+	}
+	return json.NewEncoder(w).Encode(jm)
+}
+
+// ReadModelJSON loads the BPE model from the JSON export produced by
+// WriteModelJSON.
+func ReadModelJSON(reader io.Reader) (*Model, error) {
+	var jm jsonModel
+	if err := json.NewDecoder(reader).Decode(&jm); err != nil {
+		logrus.Error("Broken input: ", err)
+		return &Model{}, err
+	}
+	if jm.Version != jsonModelVersion {
+		logrus.Errorf("Broken input: unknown JSON model version %d", jm.Version)
+		return &Model{}, errors.New("broken input: unknown JSON model version")
+	}
+
+	model := newModel(len(jm.Rules))
+	minCharID := TokenID(0)
+	for _, jc := range jm.Chars {
+		chars := []rune(jc.Char)
+		if len(chars) != 1 {
+			logrus.Errorf("Broken input: %q is not a single char", jc.Char)
+			return &Model{}, errors.New("broken input: char entry is not a single rune")
+		}
+		char := chars[0]
+		model.char2id[char] = jc.ID
+		model.id2char[jc.ID] = char
+		model.recipe[jc.ID] = EncodedString{jc.ID}
+		model.revRecipe[string(char)] = jc.ID
+		if jc.ID < minCharID || minCharID == 0 {
+			minCharID = jc.ID
+			model.spaceID = jc.ID
+		}
+	}
+
+	for i, jr := range jm.Rules {
+		r := rule{left: jr.Left, right: jr.Right, result: jr.Result}
+		model.rules[i] = r
+		if _, ok := model.recipe[r.left]; !ok {
+			logrus.Errorf("%d: token id not described before", r.left)
+			return model, errors.New("token id is impossible")
+		}
+		if _, ok := model.recipe[r.right]; !ok {
+			logrus.Errorf("%d: token id not described before", r.right)
+			return model, errors.New("token id is impossible")
+		}
+		model.recipe[r.result] = append(model.recipe[r.left], model.recipe[r.right]...)
+		resultString, err := DecodeToken(model.recipe[r.result], model.id2char)
+		if err != nil {
+			logrus.Error("Unexpected token id inside the rules: ", err)
+			return model, err
+		}
+		model.revRecipe[resultString] = r.result
+	}
+
+	for _, jst := range jm.SpecialTokens {
+		model.specialTokens[jst.Name] = specialTokenInfo{id: jst.ID, isBeginningOfSequence: jst.IsBeginningOfSequence}
+	}
+	return model, nil
+}
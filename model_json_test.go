@@ -0,0 +1,194 @@
+package bpe
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteModelJSONReadModelJSONRoundTrip(t *testing.T) {
+	m := buildTestModel()
+	var buf bytes.Buffer
+	if err := WriteModelJSON(&buf, m); err != nil {
+		t.Fatalf("WriteModelJSON: %v", err)
+	}
+	got, err := ReadModelJSON(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadModelJSON: %v", err)
+	}
+	for char, id := range m.char2id {
+		if got.char2id[char] != id {
+			t.Errorf("char %q: got id %d, want %d", char, got.char2id[char], id)
+		}
+	}
+	for name, info := range m.specialTokens {
+		if got.specialTokens[name] != info {
+			t.Errorf("special token %q: got %+v, want %+v", name, got.specialTokens[name], info)
+		}
+	}
+}
+
+// TestModelJSONRoundTripYieldsOriginalBytes verifies that loading a binary
+// dump, exporting it to JSON and back, and writing it out again as binary
+// must reproduce the original bytes exactly. That's only possible once
+// char and special-token iteration is deterministic.
+func TestModelJSONRoundTripYieldsOriginalBytes(t *testing.T) {
+	m := buildTestModel()
+	var original bytes.Buffer
+	if err := WriteModel(&original, m); err != nil {
+		t.Fatalf("WriteModel: %v", err)
+	}
+
+	loaded, err := ReadModel(bytes.NewReader(original.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadModel: %v", err)
+	}
+
+	var jsonBuf bytes.Buffer
+	if err := WriteModelJSON(&jsonBuf, loaded); err != nil {
+		t.Fatalf("WriteModelJSON: %v", err)
+	}
+	fromJSON, err := ReadModelJSON(bytes.NewReader(jsonBuf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadModelJSON: %v", err)
+	}
+
+	var roundTripped bytes.Buffer
+	if err := WriteModel(&roundTripped, fromJSON); err != nil {
+		t.Fatalf("WriteModel: %v", err)
+	}
+	if !bytes.Equal(original.Bytes(), roundTripped.Bytes()) {
+		t.Fatalf("binary -> JSON -> binary round trip did not reproduce the original bytes")
+	}
+}
+
+func TestWriteModelJSONEdgeCases(t *testing.T) {
+	t.Run("non-BMP rune", func(t *testing.T) {
+		m := newModel(0)
+		m.char2id['\U0001F600'] = 0 // 😀, outside the Basic Multilingual Plane
+		m.id2char[0] = '\U0001F600'
+		m.recipe[0] = EncodedString{0}
+		m.revRecipe[string('\U0001F600')] = 0
+
+		var buf bytes.Buffer
+		if err := WriteModelJSON(&buf, m); err != nil {
+			t.Fatalf("WriteModelJSON: %v", err)
+		}
+		got, err := ReadModelJSON(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("ReadModelJSON: %v", err)
+		}
+		if got.char2id['\U0001F600'] != 0 {
+			t.Errorf("non-BMP rune did not round-trip: got %+v", got.char2id)
+		}
+	})
+
+	t.Run("empty rule list", func(t *testing.T) {
+		m := newModel(0)
+		m.char2id['a'] = 0
+		m.id2char[0] = 'a'
+		m.recipe[0] = EncodedString{0}
+		m.revRecipe["a"] = 0
+
+		var buf bytes.Buffer
+		if err := WriteModelJSON(&buf, m); err != nil {
+			t.Fatalf("WriteModelJSON: %v", err)
+		}
+		got, err := ReadModelJSON(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("ReadModelJSON: %v", err)
+		}
+		if len(got.rules) != 0 {
+			t.Errorf("expected no rules, got %d", len(got.rules))
+		}
+	})
+
+	t.Run("no special tokens registered", func(t *testing.T) {
+		m := newModel(0)
+		m.char2id['a'] = 0
+		m.id2char[0] = 'a'
+		m.recipe[0] = EncodedString{0}
+		m.revRecipe["a"] = 0
+
+		var buf bytes.Buffer
+		if err := WriteModelJSON(&buf, m); err != nil {
+			t.Fatalf("WriteModelJSON: %v", err)
+		}
+		got, err := ReadModelJSON(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("ReadModelJSON: %v", err)
+		}
+		if len(got.specialTokens) != 0 {
+			t.Errorf("expected no special tokens, got %+v", got.specialTokens)
+		}
+	})
+}
+
+// TestSingleFourByteSpecialTokenRoundTrips is a regression test ensuring
+// that a model with exactly one special token whose name is 4 bytes long
+// (e.g. "mask") is not misread as the legacy fixed UNK/PAD/BOS/EOS layout,
+// whose special-tokens frame is 16 bytes, close to the 17 bytes such a
+// token takes in the name->id layout. Both the fixed-width and varint
+// formats must decode it back as the single "mask" token.
+func TestSingleFourByteSpecialTokenRoundTrips(t *testing.T) {
+	m := buildTestModel()
+	m.specialTokens = map[string]specialTokenInfo{"mask": {id: 5}}
+
+	var fixedBuf bytes.Buffer
+	if err := WriteModel(&fixedBuf, m); err != nil {
+		t.Fatalf("WriteModel: %v", err)
+	}
+	gotFixed, err := ReadModel(bytes.NewReader(fixedBuf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadModel: %v", err)
+	}
+	if len(gotFixed.specialTokens) != 1 || gotFixed.specialTokens["mask"].id != 5 {
+		t.Fatalf("fixed-width: got %+v, want {mask: 5}", gotFixed.specialTokens)
+	}
+
+	var varintBuf bytes.Buffer
+	if err := WriteModelVarint(&varintBuf, m); err != nil {
+		t.Fatalf("WriteModelVarint: %v", err)
+	}
+	gotVarint, err := ReadModel(bytes.NewReader(varintBuf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadModel: %v", err)
+	}
+	if len(gotVarint.specialTokens) != 1 || gotVarint.specialTokens["mask"].id != 5 {
+		t.Fatalf("varint: got %+v, want {mask: 5}", gotVarint.specialTokens)
+	}
+}
+
+// TestBeginningOfSequenceTraitSurvivesBinaryRoundTrip is a regression test
+// ensuring that a beginning-of-sequence token named something other than
+// "bos" keeps the trait when written and read back as binary or varint,
+// not just JSON: both decoders must read the trait off the wire instead
+// of re-deriving it from the token's name.
+func TestBeginningOfSequenceTraitSurvivesBinaryRoundTrip(t *testing.T) {
+	m := buildTestModel()
+	m.specialTokens = map[string]specialTokenInfo{}
+	m.AddBeginningOfSequenceToken("cls", 5)
+
+	var fixedBuf bytes.Buffer
+	if err := WriteModel(&fixedBuf, m); err != nil {
+		t.Fatalf("WriteModel: %v", err)
+	}
+	gotFixed, err := ReadModel(bytes.NewReader(fixedBuf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadModel: %v", err)
+	}
+	if !gotFixed.specialTokens["cls"].isBeginningOfSequence {
+		t.Errorf("fixed-width: \"cls\" lost its beginning-of-sequence trait across a round trip")
+	}
+
+	var varintBuf bytes.Buffer
+	if err := WriteModelVarint(&varintBuf, m); err != nil {
+		t.Fatalf("WriteModelVarint: %v", err)
+	}
+	gotVarint, err := ReadModel(bytes.NewReader(varintBuf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadModel: %v", err)
+	}
+	if !gotVarint.specialTokens["cls"].isBeginningOfSequence {
+		t.Errorf("varint: \"cls\" lost its beginning-of-sequence trait across a round trip")
+	}
+}
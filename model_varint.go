@@ -0,0 +1,299 @@
+package bpe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WriteModelVarint writes m to w using the same CRC-framed block layout as
+// WriteModel, but with a variable-width encoding of nChars, nRules, char
+// codepoints and rule operands via binary.PutUvarint. For a large
+// vocabulary this is substantially smaller than WriteModel's fixed 4-byte
+// fields, since most rule operands and all ASCII codepoints fit in one or
+// two bytes. The special tokens frame uses the name->id map layout, via
+// specialTokenMapToVarintBinary, so this writes
+// modelVersionVarintNamedTokens; modelVersionVarint dumps, with their fixed
+// UNK/PAD/BOS/EOS special token slots, are only ever read back, never
+// written, by this build.
+func WriteModelVarint(w io.Writer, m *Model) error {
+	if err := writeModelMagicAndVersion(w, modelVersionVarintNamedTokens); err != nil {
+		return err
+	}
+
+	var crc uint32
+
+	header := appendUvarint(nil, uint64(len(m.char2id)))
+	header = appendUvarint(header, uint64(len(m.rules)))
+	crc, err := writeFrame(w, header, crc)
+	if err != nil {
+		return err
+	}
+
+	charTable := make([]byte, 0, 4*len(m.char2id))
+	for _, char := range sortedChars(m.char2id) {
+		charTable = appendUvarint(charTable, uint64(char))
+		charTable = appendUvarint(charTable, uint64(m.char2id[char]))
+	}
+	crc, err = writeFrame(w, charTable, crc)
+	if err != nil {
+		return err
+	}
+
+	rulesBlock := make([]byte, 0, 6*len(m.rules))
+	for _, r := range m.rules {
+		rulesBlock = appendUvarint(rulesBlock, uint64(r.left))
+		rulesBlock = appendUvarint(rulesBlock, uint64(r.right))
+		rulesBlock = appendUvarint(rulesBlock, uint64(r.result))
+	}
+	crc, err = writeFrame(w, rulesBlock, crc)
+	if err != nil {
+		return err
+	}
+
+	_, err = writeFrame(w, specialTokenMapToVarintBinary(m.specialTokens), crc)
+	return err
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(tmp, v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(tmp, v)
+	return append(buf, tmp[:n]...)
+}
+
+// legacySpecialTokensVarint decodes the fixed four-slot (unk, pad, bos, eos)
+// special tokens frame that modelVersionVarint dumps carried before special
+// tokens became a name->id map, mirroring legacySpecialTokens/
+// binaryToSpecialTokens for the fixed-width format. Each slot is a varint
+// int64, -1 meaning "unset", in the same unk/pad/bos/eos order WriteModelVarint
+// wrote before dcb32d3 switched the special tokens frame to the name->id map
+// layout.
+func legacySpecialTokensVarint(buf []byte) (legacySpecialTokens, error) {
+	var s legacySpecialTokens
+	r := bytes.NewReader(buf)
+	unk, err := binary.ReadVarint(r)
+	if err != nil {
+		return s, errors.New("broken input: malformed special tokens frame")
+	}
+	pad, err := binary.ReadVarint(r)
+	if err != nil {
+		return s, errors.New("broken input: malformed special tokens frame")
+	}
+	bos, err := binary.ReadVarint(r)
+	if err != nil {
+		return s, errors.New("broken input: malformed special tokens frame")
+	}
+	eos, err := binary.ReadVarint(r)
+	if err != nil {
+		return s, errors.New("broken input: malformed special tokens frame")
+	}
+	s.unk = int32(unk)
+	s.pad = int32(pad)
+	s.bos = int32(bos)
+	s.eos = int32(eos)
+	return s, nil
+}
+
+// specialTokenMapToVarintBinary serializes a name->id special token map as
+// (count uvarint, [(nameLen uvarint, nameBytes, id varint,
+// isBeginningOfSequence byte)...]), in name order so two calls on the same
+// tokens always produce the same bytes. The id is signed and
+// varint-encoded, unlike specialTokenMapToBinary's fixed int32, so a
+// negative sentinel such as -1 costs a single byte here.
+func specialTokenMapToVarintBinary(tokens map[string]specialTokenInfo) []byte {
+	buf := appendUvarint(nil, uint64(len(tokens)))
+	for _, name := range sortedSpecialTokenNames(tokens) {
+		info := tokens[name]
+		nameBytes := []byte(name)
+		buf = appendUvarint(buf, uint64(len(nameBytes)))
+		buf = append(buf, nameBytes...)
+		buf = appendVarint(buf, int64(int32(info.id)))
+		if info.isBeginningOfSequence {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	}
+	return buf
+}
+
+// binaryToSpecialTokenMapVarint decodes the frame written by
+// specialTokenMapToVarintBinary, including the isBeginningOfSequence byte
+// that records the trait regardless of the token's name.
+func binaryToSpecialTokenMapVarint(buf []byte) (map[string]specialTokenInfo, error) {
+	r := bytes.NewReader(buf)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errors.New("broken input: malformed special tokens frame")
+	}
+	tokens := make(map[string]specialTokenInfo, count)
+	for i := uint64(0); i < count; i++ {
+		nameLen, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errors.New("broken input: malformed special tokens frame")
+		}
+		nameBytes := make([]byte, nameLen)
+		if _, err := io.ReadFull(r, nameBytes); err != nil {
+			return nil, errors.New("broken input: malformed special tokens frame")
+		}
+		name := string(nameBytes)
+		id, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, errors.New("broken input: malformed special tokens frame")
+		}
+		isBeginningOfSequence, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.New("broken input: malformed special tokens frame")
+		}
+		tokens[name] = specialTokenInfo{id: TokenID(int32(id)), isBeginningOfSequence: isBeginningOfSequence != 0}
+	}
+	return tokens, nil
+}
+
+// readModelVarintBody decodes every frame shared by modelVersionVarint and
+// modelVersionVarintNamedTokens - header, char table and rules, all
+// varint-encoded - and returns the still-undecoded special tokens frame so
+// each version's decoder can interpret it in its own layout, mirroring
+// readModelFixedWidthBody for the fixed-width format family.
+func readModelVarintBody(reader io.Reader) (model *Model, specialTokensBuf []byte, err error) {
+	var crc uint32
+
+	header, crc, err := readFrame(reader, "header", crc)
+	if err != nil {
+		logrus.Error("Broken input: ", err)
+		return &Model{}, nil, err
+	}
+	headerReader := bytes.NewReader(header)
+	nChars64, err := binary.ReadUvarint(headerReader)
+	if err != nil {
+		return &Model{}, nil, errors.New("broken input: malformed header frame")
+	}
+	nRules64, err := binary.ReadUvarint(headerReader)
+	if err != nil {
+		return &Model{}, nil, errors.New("broken input: malformed header frame")
+	}
+	if nChars64 > uint64(maxHeaderCount(2)) {
+		return &Model{}, nil, fmt.Errorf("broken input: implausible char count %d", nChars64)
+	}
+	if nRules64 > uint64(maxHeaderCount(3)) {
+		return &Model{}, nil, fmt.Errorf("broken input: implausible rule count %d", nRules64)
+	}
+	nChars, nRules := int(nChars64), int(nRules64)
+
+	model = newModel(nRules)
+
+	charTable, crc, err := readFrame(reader, "char table", crc)
+	if err != nil {
+		logrus.Error("Broken input: ", err)
+		return &Model{}, nil, err
+	}
+	charReader := bytes.NewReader(charTable)
+	minCharID := TokenID(0)
+	for i := 0; i < nChars; i++ {
+		charCode, err := binary.ReadUvarint(charReader)
+		if err != nil {
+			return &Model{}, nil, errors.New("broken input: malformed char table frame")
+		}
+		charID64, err := binary.ReadUvarint(charReader)
+		if err != nil {
+			return &Model{}, nil, errors.New("broken input: malformed char table frame")
+		}
+		char := rune(charCode)
+		charID := TokenID(charID64)
+		model.char2id[char] = charID
+		model.id2char[charID] = char
+		model.recipe[charID] = EncodedString{charID}
+		model.revRecipe[string(char)] = charID
+		if charID < minCharID || minCharID == 0 {
+			minCharID = charID
+			model.spaceID = charID
+		}
+	}
+
+	rulesBlock, crc, err := readFrame(reader, "rules", crc)
+	if err != nil {
+		logrus.Error("Broken input: ", err)
+		return &Model{}, nil, err
+	}
+	rulesReader := bytes.NewReader(rulesBlock)
+	for i := 0; i < nRules; i++ {
+		left, err := binary.ReadUvarint(rulesReader)
+		if err != nil {
+			return model, nil, errors.New("broken input: malformed rules frame")
+		}
+		right, err := binary.ReadUvarint(rulesReader)
+		if err != nil {
+			return model, nil, errors.New("broken input: malformed rules frame")
+		}
+		result, err := binary.ReadUvarint(rulesReader)
+		if err != nil {
+			return model, nil, errors.New("broken input: malformed rules frame")
+		}
+		r := rule{left: TokenID(left), right: TokenID(right), result: TokenID(result)}
+		model.rules[i] = r
+		if _, ok := model.recipe[r.left]; !ok {
+			logrus.Errorf("%d: token id not described before", r.left)
+			return model, nil, errors.New("token id is impossible")
+		}
+		if _, ok := model.recipe[r.right]; !ok {
+			logrus.Errorf("%d: token id not described before", r.right)
+			return model, nil, errors.New("token id is impossible")
+		}
+		model.recipe[r.result] = append(model.recipe[r.left], model.recipe[r.right]...)
+		resultString, err := DecodeToken(model.recipe[r.result], model.id2char)
+		if err != nil {
+			logrus.Error("Unexpected token id inside the rules: ", err)
+			return model, nil, err
+		}
+		model.revRecipe[resultString] = r.result
+	}
+
+	specialTokensBuf, _, err = readFrame(reader, "special tokens", crc)
+	if err != nil {
+		logrus.Error("Broken input: ", err)
+		return &Model{}, nil, err
+	}
+	return model, specialTokensBuf, nil
+}
+
+// readModelVarint decodes a modelVersionVarint dump, whose special tokens
+// frame is the fixed four-slot UNK/PAD/BOS/EOS layout from before special
+// tokens became a name->id map.
+func readModelVarint(reader io.Reader) (*Model, error) {
+	model, specialTokensBuf, err := readModelVarintBody(reader)
+	if err != nil {
+		return model, err
+	}
+	legacy, err := legacySpecialTokensVarint(specialTokensBuf)
+	if err != nil {
+		return model, err
+	}
+	model.specialTokens = legacyToSpecialTokenMap(legacy)
+	return model, nil
+}
+
+// readModelVarintNamedTokens decodes a modelVersionVarintNamedTokens dump,
+// whose special tokens frame is the name->id map layout written by
+// specialTokenMapToVarintBinary.
+func readModelVarintNamedTokens(reader io.Reader) (*Model, error) {
+	model, specialTokensBuf, err := readModelVarintBody(reader)
+	if err != nil {
+		return model, err
+	}
+	specials, err := binaryToSpecialTokenMapVarint(specialTokensBuf)
+	if err != nil {
+		return model, err
+	}
+	model.specialTokens = specials
+	return model, nil
+}
@@ -0,0 +1,131 @@
+package bpe
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestWriteModelVarintReadModelVarintRoundTrip(t *testing.T) {
+	m := buildTestModel()
+	var buf bytes.Buffer
+	if err := WriteModelVarint(&buf, m); err != nil {
+		t.Fatalf("WriteModelVarint: %v", err)
+	}
+	got, err := ReadModel(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadModel: %v", err)
+	}
+	for char, id := range m.char2id {
+		if got.char2id[char] != id {
+			t.Errorf("char %q: got id %d, want %d", char, got.char2id[char], id)
+		}
+	}
+	if !reflect.DeepEqual(got.rules, m.rules) {
+		t.Errorf("rules: got %+v, want %+v", got.rules, m.rules)
+	}
+	for name, info := range m.specialTokens {
+		if got.specialTokens[name] != info {
+			t.Errorf("special token %q: got %+v, want %+v", name, got.specialTokens[name], info)
+		}
+	}
+}
+
+func TestWriteModelVarintDeterministic(t *testing.T) {
+	m := buildTestModel()
+	var first, second bytes.Buffer
+	if err := WriteModelVarint(&first, m); err != nil {
+		t.Fatalf("WriteModelVarint: %v", err)
+	}
+	if err := WriteModelVarint(&second, m); err != nil {
+		t.Fatalf("WriteModelVarint: %v", err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Fatalf("WriteModelVarint produced different bytes across two calls on the same model")
+	}
+}
+
+// TestSpecialTokenNegativeIDEncodesAsOneVarintByte verifies that a negative
+// special token id (the legacy "unset" -1 sentinel) costs a single byte in
+// the varint special-tokens frame, not the four bytes a fixed-width int32
+// would take.
+func TestSpecialTokenNegativeIDEncodesAsOneVarintByte(t *testing.T) {
+	var negativeOne int32 = -1
+	tokens := map[string]specialTokenInfo{"unk": {id: TokenID(negativeOne)}}
+	buf := specialTokenMapToVarintBinary(tokens)
+	// 1 byte count + 1 byte nameLen + 3 bytes "unk" + 1 byte id + 1 byte
+	// isBeginningOfSequence == 7.
+	if len(buf) != 7 {
+		t.Fatalf("expected a 7-byte frame with a 1-byte id, got %d bytes (% x)", len(buf), buf)
+	}
+	decoded, err := binaryToSpecialTokenMapVarint(buf)
+	if err != nil {
+		t.Fatalf("binaryToSpecialTokenMapVarint: %v", err)
+	}
+	if decoded["unk"].id != TokenID(negativeOne) {
+		t.Errorf("got id %d, want -1", int32(decoded["unk"].id))
+	}
+}
+
+// TestWriteModelVarintSmallerForLargeVocab demonstrates the compression
+// WriteModelVarint is meant to provide: with a vocabulary big enough that
+// most ids no longer fit a single varint byte but still fit well under
+// the fixed-width format's 4 bytes each, the varint dump must come out
+// smaller.
+func TestWriteModelVarintSmallerForLargeVocab(t *testing.T) {
+	m := buildLargeTestModel(2000)
+
+	var fixedBuf, varintBuf bytes.Buffer
+	if err := WriteModel(&fixedBuf, m); err != nil {
+		t.Fatalf("WriteModel: %v", err)
+	}
+	if err := WriteModelVarint(&varintBuf, m); err != nil {
+		t.Fatalf("WriteModelVarint: %v", err)
+	}
+	if varintBuf.Len() >= fixedBuf.Len() {
+		t.Fatalf("expected varint dump (%d bytes) to be smaller than fixed-width dump (%d bytes)",
+			varintBuf.Len(), fixedBuf.Len())
+	}
+}
+
+func buildLargeTestModel(nChars int) *Model {
+	m := newModel(nChars - 1)
+	for i := 0; i < nChars; i++ {
+		char := rune('a' + i)
+		id := TokenID(i)
+		m.char2id[char] = id
+		m.id2char[id] = char
+		m.recipe[id] = EncodedString{id}
+		m.revRecipe[string(char)] = id
+	}
+	for i := 0; i < nChars-1; i++ {
+		left, right := TokenID(i), TokenID(i+1)
+		result := TokenID(nChars + i)
+		m.rules[i] = rule{left: left, right: right, result: result}
+		m.recipe[result] = append(append(EncodedString{}, m.recipe[left]...), m.recipe[right]...)
+	}
+	m.AddSpecialToken(unkTokenName, 0)
+	return m
+}
+
+func BenchmarkWriteModel(b *testing.B) {
+	m := buildLargeTestModel(2000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		if err := WriteModel(&buf, m); err != nil {
+			b.Fatalf("WriteModel: %v", err)
+		}
+	}
+}
+
+func BenchmarkWriteModelVarint(b *testing.B) {
+	m := buildLargeTestModel(2000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		if err := WriteModelVarint(&buf, m); err != nil {
+			b.Fatalf("WriteModelVarint: %v", err)
+		}
+	}
+}